@@ -0,0 +1,852 @@
+/*
+ *
+ * Copyright 2023 gRPC authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package xdsclient implements a full fledged gRPC client for the xDS API
+// used by the xds resolver and balancer implementations.
+package xdsclient
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	otelmetric "go.opentelemetry.io/otel/metric"
+	"google.golang.org/grpc/internal/backoff"
+	"google.golang.org/grpc/internal/grpclog"
+	"google.golang.org/grpc/internal/grpcsync"
+	"google.golang.org/grpc/xds/internal/xdsclient/bootstrap"
+	"google.golang.org/grpc/xds/internal/xdsclient/transport"
+	"google.golang.org/grpc/xds/internal/xdsclient/xdsresource"
+)
+
+// watchState is the state of a resource watch maintained by an authority.
+type watchState int
+
+const (
+	// watchStateCached is the state of a newly registered watch whose
+	// resource was found in the on-disk ResourceCache (see cache.go). The
+	// watcher has already been given the cached value, but it is not yet
+	// known whether the management server will confirm, update or remove
+	// it; the watch transitions to watchStateRequested as soon as the
+	// corresponding request is sent on the ADS stream, same as it would
+	// from watchStateStarted.
+	watchStateCached watchState = iota
+	// watchStateStarted is the state where a watch for a resource was just
+	// registered, or when the authority is about to re-request the resource
+	// (e.g. after a stream error, or after switching to a new server).
+	watchStateStarted
+	// watchStateRequested is the state when the authority has sent a
+	// discovery request for the resource on the current ADS stream, and is
+	// waiting either for a response, or for the watch expiry timer to fire.
+	watchStateRequested
+	// watchStateReceived is the state when the authority has received a
+	// valid update for the resource from the management server.
+	watchStateReceived
+	// watchStateTimeout is the state when the watch expiry timer fired
+	// before the management server responded to the corresponding
+	// discovery request.
+	watchStateTimeout
+)
+
+// resourceState keeps track of the watchers registered for a resource, and
+// the state of the corresponding watch (whether it has been requested on the
+// current ADS stream, whether an update has ever been received, etc).
+type resourceState struct {
+	watchers map[xdsresource.ResourceWatcher]bool
+
+	wState watchState
+	wTimer *time.Timer
+
+	// version is the most recent per-resource version string this resource
+	// was received with, as reported by the transport's OnRecvHandler. It is
+	// empty until the first update arrives, and is cleared again if the
+	// management server explicitly removes the resource (handleResourceRemoved),
+	// since that invalidates the last known value. It is used to populate
+	// initial_resource_versions when (re-)subscribing on a Delta (Incremental)
+	// ADS stream, so the management server knows it doesn't need to resend a
+	// resource the authority already has; a SotW transport ignores it.
+	version string
+
+	// registeredAt is when the watch was first registered. firstUpdateDone
+	// guards recordTimeToFirstUpdate so that the time-to-first-response
+	// histogram only ever gets one sample per resource, even if it flips
+	// back and forth between watchStateReceived and an in-flight state
+	// later on (e.g. across a fallback switch).
+	registeredAt    time.Time
+	firstUpdateDone bool
+}
+
+// authorityArgs is a convenience struct to wrap arguments required to create
+// a new authority. The fields from serverCfg through logger are required;
+// the fields after logger are optional.
+type authorityArgs struct {
+	serverCfg          *bootstrap.ServerConfig
+	bootstrapCfg       *bootstrap.Config
+	serializer         *grpcsync.CallbackSerializer
+	resourceTypeGetter func(string) xdsresource.Type
+	watchExpiryTimeout time.Duration
+	logger             *grpclog.PrefixLogger
+
+	// fallbackServerCfgs, when non-empty, lists the management servers that
+	// this authority should fall back to, in order, when the current ADS
+	// stream keeps erroring out or timing out. serverCfg above is always
+	// index zero of this list, i.e. the primary/preferred server.
+	fallbackServerCfgs []*bootstrap.ServerConfig
+
+	// fallbackProbeInterval controls how often a healthy fallback authority
+	// probes the primary server to see whether it has recovered. Defaults to
+	// defaultFallbackProbeInterval when zero.
+	fallbackProbeInterval time.Duration
+
+	// onFallbackForTesting, when set, is wired up onto the authority
+	// unmodified. See the authority field of the same name.
+	onFallbackForTesting func(prevIdx, newIdx int)
+
+	// backoffForTesting, when set, overrides the default exponential backoff
+	// used between retries of the same server, so that tests exercising the
+	// retry-before-fallback path don't have to wait out real backoff delays.
+	// Defaults to backoff.DefaultExponential.Backoff when nil.
+	backoffForTesting func(int) time.Duration
+
+	// cache, when non-nil, is consulted on every new watch for a warm-start
+	// value, and updated with every value successfully received from the
+	// management server. See cache.go.
+	cache ResourceCache
+
+	// meterProvider, when non-nil, is used to create the OpenTelemetry
+	// instruments described in metrics.go. Defaults to the no-op provider.
+	meterProvider otelmetric.MeterProvider
+}
+
+const (
+	// serverFeatureDeltaXDS is the server_features bootstrap entry that
+	// opts a management server into the Delta (Incremental) xDS transport
+	// protocol (ADS's DeltaAggregatedResources RPC) instead of the default
+	// State-of-the-World one (StreamAggregatedResources). This mirrors how
+	// serverFeaturesIgnoreResourceDeletion and similar flags are plumbed
+	// through bootstrap server_features in the bootstrap package.
+	serverFeatureDeltaXDS = "xds_v3_delta"
+)
+
+const (
+	// defaultFallbackProbeInterval is how often the authority attempts to
+	// reconnect to a higher-priority (primary) server while running against
+	// a fallback server.
+	defaultFallbackProbeInterval = 5 * time.Minute
+	// maxConsecutiveStreamErrorsBeforeFallback bounds how many times in a
+	// row the ADS stream to the current server can fail (error out or time
+	// out), with a per-server backoff delay between attempts, before the
+	// authority gives up on it and switches over to the next server in its
+	// list. A value of 1 would fail over on the very first transient blip;
+	// this is intentionally large enough to ride out brief connectivity
+	// hiccups on the primary server.
+	maxConsecutiveStreamErrorsBeforeFallback = 5
+)
+
+// authority is the translation unit for the xDS client. It owns the
+// transport used to talk to one (at a time) xDS management server and the
+// state (watchers and cached values) for every resource requested through
+// it.
+//
+// In the absence of server fallback, an authority talks to a single
+// management server for its entire lifetime. When fallback is configured
+// (via a bootstrap entry specifying more than one server_uri), the authority
+// moves through its ordered list of servers as the active one repeatedly
+// fails, and periodically reverts back to the primary server once a probe
+// of it succeeds (see probePrimary).
+type authority struct {
+	bootstrapCfg       *bootstrap.Config
+	serializer         *grpcsync.CallbackSerializer
+	resourceTypeGetter func(string) xdsresource.Type
+	watchExpiryTimeout time.Duration
+	backoff            func(int) time.Duration
+	logger             *grpclog.PrefixLogger
+
+	serverCfgs            []*bootstrap.ServerConfig
+	fallbackProbeInterval time.Duration
+
+	// onFallbackForTesting, when non-nil, is invoked (synchronously, from
+	// whichever goroutine triggers the switch) every time the authority
+	// switches its active server, including reverts back to a
+	// higher-priority server. Tests use this hook to observe fallback
+	// events instead of poking at private fields.
+	onFallbackForTesting func(prevIdx, newIdx int)
+
+	// cache is consulted for a warm-start value when a resource is first
+	// watched, and updated whenever a fresh value is received from the
+	// management server. Nil when no ResourceCache was configured.
+	cache ResourceCache
+
+	// metrics records OpenTelemetry instrumentation for this authority's
+	// watch state machine and ADS stream health. See metrics.go.
+	metrics *authorityMetrics
+
+	// mu guards the fields that track the active server and the transport
+	// used to talk to it.
+	mu              sync.Mutex
+	activeServerIdx int
+	transport       transport.Transport
+	// serverRetries holds, for each entry in serverCfgs, the number of
+	// consecutive stream errors seen against that server since it last
+	// connected successfully. It is what handleADSStreamError consults (and
+	// feeds into backoff) to decide between retrying the current server and
+	// falling back to the next one.
+	serverRetries []int
+	closed        bool
+	probeTimer    *time.Timer
+
+	resourcesMu sync.Mutex
+	// resources is a map from the resource type to the resource name to the
+	// resource's watch state. It covers all the resources that currently
+	// have a watch registered, regardless of which server is currently
+	// active.
+	resources map[xdsresource.Type]map[string]*resourceState
+}
+
+// newAuthority creates a new authority and starts a stream to the highest
+// priority management server configured for it.
+func newAuthority(args authorityArgs) (*authority, error) {
+	serverCfgs := append([]*bootstrap.ServerConfig{args.serverCfg}, args.fallbackServerCfgs...)
+	probeInterval := args.fallbackProbeInterval
+	if probeInterval == 0 {
+		probeInterval = defaultFallbackProbeInterval
+	}
+
+	metrics, err := newAuthorityMetrics(args.meterProvider)
+	if err != nil {
+		return nil, fmt.Errorf("xds: failed to create OpenTelemetry instruments: %v", err)
+	}
+	backoffFn := args.backoffForTesting
+	if backoffFn == nil {
+		backoffFn = backoff.DefaultExponential.Backoff
+	}
+
+	a := &authority{
+		bootstrapCfg:          args.bootstrapCfg,
+		serializer:            args.serializer,
+		resourceTypeGetter:    args.resourceTypeGetter,
+		watchExpiryTimeout:    args.watchExpiryTimeout,
+		backoff:               backoffFn,
+		logger:                args.logger,
+		serverCfgs:            serverCfgs,
+		fallbackProbeInterval: probeInterval,
+		onFallbackForTesting:  args.onFallbackForTesting,
+		cache:                 args.cache,
+		metrics:               metrics,
+		serverRetries:         make([]int, len(serverCfgs)),
+		resources:             make(map[xdsresource.Type]map[string]*resourceState),
+	}
+
+	t, err := a.createTransport(0)
+	if err != nil {
+		return nil, fmt.Errorf("xds: failed to create a transport for server %v: %v", serverCfgs[0], err)
+	}
+	a.transport = t
+	return a, nil
+}
+
+// createTransport creates a transport to the server at serverCfgs[idx], with
+// handlers wired up to record resource updates and stream errors against
+// this authority.
+//
+// Whether the transport speaks the State-of-the-World or the Delta
+// (Incremental) variant of ADS is decided per-server, based on whether
+// serverCfgs[idx] opts into serverFeatureDeltaXDS. Either way, the watch
+// state transitions observed by watchResource callers are identical:
+// watchStateRequested once the (full or incremental) request is on the
+// wire, watchStateReceived once a value for the resource has arrived.
+//
+// The two protocol variants differ in how removal and resumption are
+// represented on the wire (full Resources/RemovedResources deltas with
+// per-resource versions and nonces, versus a complete snapshot every time),
+// but the transport is responsible for that bookkeeping; it hands the
+// authority the resulting per-resource version (OnRecvHandler) and removal
+// (OnRemoveHandler) events, and accepts a per-resource version map from
+// SendRequest to populate initial_resource_versions on a Delta stream (see
+// subscriptionState).
+func (a *authority) createTransport(idx int) (transport.Transport, error) {
+	return transport.New(transport.Options{
+		ServerCfg:       a.serverCfgs[idx],
+		NodeProto:       a.bootstrapCfg.NodeProto,
+		UseDeltaXDS:     serverFeaturesContain(a.serverCfgs[idx], serverFeatureDeltaXDS),
+		OnRecvHandler:   a.handleResourceUpdate,
+		OnRemoveHandler: a.handleResourceRemoved,
+		OnNACKHandler:   a.handleResourceNACKed,
+		OnErrorHandler:  func(err error) { a.handleADSStreamError(idx, err) },
+		OnSendHandler:   a.handleResourceSent,
+		Backoff:         a.backoff,
+		Logger:          a.logger,
+	})
+}
+
+// handleResourceSent is invoked by the transport every time a discovery
+// request for the given resource type and name has actually been written to
+// the wire. It transitions the corresponding watch to watchStateRequested
+// and (re)starts its expiry timer.
+//
+// A resource already in watchStateReceived is left alone: replaySubscriptions
+// re-sends every watched resource on every reconnect to the same server
+// (along with its last known version, so a Delta server need not resend it
+// if unchanged), but a resource that already has a value doesn't need a
+// fresh expiry timer armed just because it was mentioned in a request again.
+// Arming one here would let it spuriously fire watchStateTimeout (and an
+// incorrect ResourceNotFound) if the new stream is slow to respond, even
+// though the watcher already has a perfectly good, still-authoritative
+// value. After a fallback switch this does not apply: switchToServer has
+// already moved every resource back to watchStateStarted, so each one gets
+// a new expiry timer when it is re-requested on the new server.
+func (a *authority) handleResourceSent(rType xdsresource.Type, resourceName string) {
+	a.resourcesMu.Lock()
+	defer a.resourcesMu.Unlock()
+
+	state, ok := a.resources[rType][resourceName]
+	if !ok {
+		return
+	}
+	if state.wState == watchStateRequested || state.wState == watchStateReceived {
+		return
+	}
+	prev := state.wState
+	state.wState = watchStateRequested
+	state.wTimer = time.AfterFunc(a.watchExpiryTimeout, func() { a.handleWatchTimerExpiry(rType, resourceName) })
+	a.metrics.recordWatchStateChange(prev, watchStateRequested)
+}
+
+// handleWatchTimerExpiry is invoked when a resource's expiry timer fires
+// before any update (or "not found") was received for it.
+func (a *authority) handleWatchTimerExpiry(rType xdsresource.Type, resourceName string) {
+	a.resourcesMu.Lock()
+	defer a.resourcesMu.Unlock()
+
+	state, ok := a.resources[rType][resourceName]
+	if !ok {
+		return
+	}
+	prev := state.wState
+	state.wState = watchStateTimeout
+	a.metrics.recordWatchStateChange(prev, watchStateTimeout)
+	a.metrics.recordWatchExpiry()
+	err := xdsresource.NewErrorf(xdsresource.ErrorTypeResourceNotFound, "xds: watch for resource %q of type %s timed out", resourceName, rType.TypeName())
+	for watcher := range state.watchers {
+		w := watcher
+		a.serializer.Schedule(func(context.Context) { w.OnError(err, func() {}) })
+	}
+}
+
+// handleResourceUpdate is invoked by the transport for every resource
+// received on the ADS stream, along with the per-resource version it was
+// received with (the version_info of the SotW response, or the Resource's
+// own version in Delta mode). It updates the corresponding watch state and
+// notifies registered watchers.
+func (a *authority) handleResourceUpdate(rType xdsresource.Type, resourceName, resourceVersion string, update xdsresource.ResourceData) {
+	// A response on the stream means the active server is working, so its
+	// count of consecutive stream errors starts over.
+	a.mu.Lock()
+	a.serverRetries[a.activeServerIdx] = 0
+	a.mu.Unlock()
+
+	a.resourcesMu.Lock()
+	state, ok := a.resources[rType][resourceName]
+	if !ok {
+		a.resourcesMu.Unlock()
+		return
+	}
+	if state.wTimer != nil {
+		state.wTimer.Stop()
+		state.wTimer = nil
+	}
+	prev := state.wState
+	state.wState = watchStateReceived
+	state.version = resourceVersion
+	a.metrics.recordWatchStateChange(prev, watchStateReceived)
+	if !state.firstUpdateDone {
+		state.firstUpdateDone = true
+		a.metrics.recordTimeToFirstUpdate(time.Since(state.registeredAt))
+	}
+	watchers := make([]xdsresource.ResourceWatcher, 0, len(state.watchers))
+	for w := range state.watchers {
+		watchers = append(watchers, w)
+	}
+	a.resourcesMu.Unlock()
+
+	if a.cache != nil {
+		if err := a.cache.Set(rType.TypeURL(), resourceName, update.Raw()); err != nil && a.logger != nil {
+			a.logger.Warningf("xds: failed to cache resource %q of type %q: %v", resourceName, rType.TypeURL(), err)
+		}
+	}
+
+	for _, w := range watchers {
+		watcher := w
+		a.serializer.Schedule(func(context.Context) { watcher.OnUpdate(update, func() {}) })
+	}
+}
+
+// handleResourceRemoved is invoked by the transport when running in Delta
+// (Incremental) xDS mode and the management server sends resourceName in a
+// response's RemovedResources list. A SotW transport never calls this, since
+// in that protocol variant resource removal is represented by the resource
+// being absent from a full-state response, which the transport already
+// translates into individual handleResourceUpdate/handleWatchTimerExpiry
+// calls.
+//
+// Unlike a stream error (where the last known value stays authoritative),
+// an explicit removal means the management server has told us the resource
+// no longer exists, so the cached version is no longer valid either: it is
+// cleared, and the next subscription for this resource won't advertise it
+// in initial_resource_versions.
+func (a *authority) handleResourceRemoved(rType xdsresource.Type, resourceName string) {
+	a.resourcesMu.Lock()
+	state, ok := a.resources[rType][resourceName]
+	if !ok {
+		a.resourcesMu.Unlock()
+		return
+	}
+	if state.wTimer != nil {
+		state.wTimer.Stop()
+		state.wTimer = nil
+	}
+	prev := state.wState
+	state.wState = watchStateStarted
+	state.version = ""
+	a.metrics.recordWatchStateChange(prev, watchStateStarted)
+	watchers := make([]xdsresource.ResourceWatcher, 0, len(state.watchers))
+	for w := range state.watchers {
+		watchers = append(watchers, w)
+	}
+	a.resourcesMu.Unlock()
+
+	for _, w := range watchers {
+		watcher := w
+		a.serializer.Schedule(func(context.Context) { watcher.OnResourceDoesNotExist(func() {}) })
+	}
+}
+
+// handleResourceNACKed is invoked by the transport when the management
+// server (or local validation of a received response) rejects a resource of
+// type rType, for example due to a malformed Listener. It only updates
+// instrumentation; the NACK itself (and the ACK/NACK bookkeeping needed to
+// build the DiscoveryRequest.error_detail field) is the transport's
+// responsibility.
+func (a *authority) handleResourceNACKed(rType xdsresource.Type, reason error) {
+	a.metrics.recordNACK(rType.TypeURL())
+}
+
+// serverFeaturesContain reports whether cfg's server_features bootstrap
+// entry lists feature.
+func serverFeaturesContain(cfg *bootstrap.ServerConfig, feature string) bool {
+	for _, f := range cfg.ServerFeatures() {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// handleADSStreamError is invoked by the transport whenever the ADS stream
+// to serverCfgs[idx] breaks, or fails to be established in the first place.
+//
+// Resources that have never received an update transition back to
+// watchStateStarted, without their expiry timer being restarted (it will be
+// restarted once the corresponding request is actually sent again, either on
+// the same stream reconnecting or on the stream to a fallback server).
+// Resources that already have a value continue to use it; xDS treats the
+// last known good value of a resource as authoritative until a newer one
+// arrives.
+//
+// serverRetries[idx] tracks how many times in a row this has happened for
+// this particular server. As long as that count is below
+// maxConsecutiveStreamErrorsBeforeFallback, the authority retries the same
+// server after a per-server backoff delay (so a single transient blip on the
+// primary does not move watches over to a fallback server). Once the
+// threshold is reached and a lower priority server is configured, the
+// authority switches over to it instead of retrying further.
+//
+// Watchers of resources that have never received a value are only notified
+// with err once there is no lower priority server left to fall back to (idx
+// is the last entry in serverCfgs): as long as a fallback exists,
+// every error on the way down the chain — same-server retries and the
+// eventual switch alike — is handled silently, since the watcher will be
+// caught up transparently as soon as a server further down the chain starts
+// working, without ever having seen an error in between.
+func (a *authority) handleADSStreamError(idx int, err error) {
+	a.mu.Lock()
+	if a.closed || idx != a.activeServerIdx {
+		// A stale transport (superseded by a fallback switch) reporting an
+		// error; nothing to do.
+		a.mu.Unlock()
+		return
+	}
+	a.serverRetries[idx]++
+	retries := a.serverRetries[idx]
+	hasFallback := idx+1 < len(a.serverCfgs)
+	giveUp := retries >= maxConsecutiveStreamErrorsBeforeFallback && hasFallback
+	a.mu.Unlock()
+
+	a.metrics.recordStreamReconnect()
+	a.resetInFlightWatches(err, !hasFallback)
+
+	if giveUp {
+		a.switchToServer(idx + 1)
+		return
+	}
+
+	delay := a.backoff(retries - 1)
+	time.AfterFunc(delay, func() { a.retryActiveServer(idx) })
+}
+
+// retryActiveServer re-creates the transport to serverCfgs[idx], which must
+// still be the active server, after a per-server backoff delay has elapsed
+// following a stream error. If the server has since stopped being active
+// (e.g. a concurrent fallback switch already moved on) this is a no-op.
+func (a *authority) retryActiveServer(idx int) {
+	a.mu.Lock()
+	if a.closed || idx != a.activeServerIdx {
+		a.mu.Unlock()
+		return
+	}
+	a.mu.Unlock()
+
+	newTransport, err := a.createTransport(idx)
+	if err != nil {
+		a.handleADSStreamError(idx, err)
+		return
+	}
+
+	a.mu.Lock()
+	if a.closed || idx != a.activeServerIdx {
+		a.mu.Unlock()
+		newTransport.Close()
+		return
+	}
+	oldTransport := a.transport
+	a.transport = newTransport
+	a.mu.Unlock()
+
+	if oldTransport != nil {
+		oldTransport.Close()
+	}
+	a.replaySubscriptions(newTransport)
+}
+
+// resetInFlightWatches transitions every resource that has never received an
+// update back to watchStateStarted, and, only if notify is true, delivers
+// err to their watchers.
+//
+// It runs on every ADS stream error, whether or not that error ends up
+// triggering a fallback switch, but notify is only set once the authority
+// has no more servers left to fall back to: as long as a retry of the same
+// server or a switch to a lower priority one can still transparently recover
+// the stream, watchers of in-flight resources are left alone rather than
+// being handed a connection error they'd immediately have to forget about
+// once the next server starts working.
+//
+// When the error does trigger a fallback switch, switchToServer performs its
+// own separate, non-notifying reset of every resource (including ones
+// already in watchStateReceived) right before replaying subscriptions on the
+// new stream; the two resets are independent because switchToServer must
+// also re-request resources that already have a value, which
+// resetInFlightWatches deliberately leaves alone.
+func (a *authority) resetInFlightWatches(err error, notify bool) {
+	a.resourcesMu.Lock()
+	var toNotify []xdsresource.ResourceWatcher
+	for _, byName := range a.resources {
+		for _, state := range byName {
+			if state.wTimer != nil {
+				state.wTimer.Stop()
+				state.wTimer = nil
+			}
+			if state.wState == watchStateReceived {
+				continue
+			}
+			prev := state.wState
+			state.wState = watchStateStarted
+			a.metrics.recordWatchStateChange(prev, watchStateStarted)
+			if notify {
+				for w := range state.watchers {
+					toNotify = append(toNotify, w)
+				}
+			}
+		}
+	}
+	a.resourcesMu.Unlock()
+
+	for _, w := range toNotify {
+		watcher := w
+		a.serializer.Schedule(func(context.Context) { watcher.OnError(err, func() {}) })
+	}
+}
+
+// switchToServer tears down the transport to the current server, resets all
+// in-flight watches (regardless of whether they have ever received a value,
+// since they must be re-requested from scratch on the new server) and opens
+// a transport to serverCfgs[idx], replaying the current subscription set on
+// it.
+//
+// If idx is 0 (the primary server), this is a revert from fallback and the
+// primary-health probe timer is stopped. Otherwise, a probe timer is
+// (re)started so that the authority can revert back to the primary once a
+// probe of it succeeds (see probePrimary).
+func (a *authority) switchToServer(idx int) {
+	a.mu.Lock()
+	if a.closed || idx == a.activeServerIdx {
+		a.mu.Unlock()
+		return
+	}
+	prevIdx := a.activeServerIdx
+	oldTransport := a.transport
+	a.activeServerIdx = idx
+	a.serverRetries[idx] = 0
+	if a.probeTimer != nil {
+		a.probeTimer.Stop()
+		a.probeTimer = nil
+	}
+	a.mu.Unlock()
+
+	if oldTransport != nil {
+		oldTransport.Close()
+	}
+
+	a.resourcesMu.Lock()
+	for _, byName := range a.resources {
+		for _, state := range byName {
+			if state.wTimer != nil {
+				state.wTimer.Stop()
+				state.wTimer = nil
+			}
+			prev := state.wState
+			state.wState = watchStateStarted
+			a.metrics.recordWatchStateChange(prev, watchStateStarted)
+		}
+	}
+	a.resourcesMu.Unlock()
+
+	newTransport, err := a.createTransport(idx)
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		if newTransport != nil {
+			newTransport.Close()
+		}
+		return
+	}
+	if err != nil {
+		// Treat a failure to even establish the fallback transport as
+		// another stream error against the new index, which will continue
+		// the fallback chain (or surface the error, if this was the last
+		// server).
+		a.mu.Unlock()
+		a.handleADSStreamError(idx, err)
+		return
+	}
+	a.transport = newTransport
+	if idx > 0 {
+		a.probeTimer = time.AfterFunc(a.fallbackProbeInterval, func() { a.probePrimary() })
+	}
+	a.mu.Unlock()
+
+	a.replaySubscriptions(newTransport)
+
+	if hook := a.onFallbackForTesting; hook != nil {
+		hook(prevIdx, idx)
+	}
+}
+
+// probePrimary is invoked periodically, while the authority is running
+// against a fallback server. A probe succeeds when a transport to the
+// primary (serverCfgs[0]) can be created, and a successful probe reverts the
+// authority back to it; whether the primary's ADS stream actually works is
+// not checked before the revert.
+func (a *authority) probePrimary() {
+	a.mu.Lock()
+	if a.closed || a.activeServerIdx == 0 {
+		a.mu.Unlock()
+		return
+	}
+	a.mu.Unlock()
+
+	probeTransport, err := a.createTransport(0)
+	if err != nil {
+		a.mu.Lock()
+		if !a.closed && a.activeServerIdx != 0 {
+			a.probeTimer = time.AfterFunc(a.fallbackProbeInterval, func() { a.probePrimary() })
+		}
+		a.mu.Unlock()
+		return
+	}
+	probeTransport.Close()
+	a.switchToServer(0)
+}
+
+// replaySubscriptions re-sends the discovery requests for every resource
+// currently being watched, on the given (freshly created) transport. This is
+// used both for a normal stream reconnect and for a fallback/revert switch.
+//
+// Each request carries the last known version of every resource that already
+// has one, via subscriptionState, so that a Delta stream's
+// initial_resource_versions lets the management server skip resending
+// resources the authority is already up to date on.
+func (a *authority) replaySubscriptions(t transport.Transport) {
+	a.resourcesMu.Lock()
+	rTypes := make([]xdsresource.Type, 0, len(a.resources))
+	for rType := range a.resources {
+		rTypes = append(rTypes, rType)
+	}
+	a.resourcesMu.Unlock()
+
+	for _, rType := range rTypes {
+		names, versions := a.subscriptionState(rType)
+		t.SendRequest(rType.TypeURL(), names, versions)
+	}
+}
+
+// watchResource registers a watch for the named resource of the given
+// resource type. It returns a function that can be called to cancel the
+// watch.
+func (a *authority) watchResource(rType xdsresource.Type, resourceName string, watcher xdsresource.ResourceWatcher) func() {
+	a.resourcesMu.Lock()
+	byName, ok := a.resources[rType]
+	if !ok {
+		byName = make(map[string]*resourceState)
+		a.resources[rType] = byName
+	}
+	state, existed := byName[resourceName]
+	var cached xdsresource.ResourceData
+	if !existed {
+		state = &resourceState{
+			watchers:     make(map[xdsresource.ResourceWatcher]bool),
+			wState:       watchStateStarted,
+			registeredAt: time.Now(),
+		}
+		if a.cache != nil {
+			if raw, ok := a.cache.Get(rType.TypeURL(), resourceName); ok {
+				if res, err := rType.Decode(&xdsresource.DecodeOptions{}, raw); err == nil && res.Resource != nil {
+					cached = res.Resource
+					state.wState = watchStateCached
+				}
+			}
+		}
+		byName[resourceName] = state
+		a.metrics.recordWatchAdded(state.wState)
+	}
+	state.watchers[watcher] = true
+	a.resourcesMu.Unlock()
+
+	if cached != nil {
+		a.serializer.Schedule(func(context.Context) { watcher.OnUpdate(cached, func() {}) })
+	}
+
+	a.mu.Lock()
+	t := a.transport
+	a.mu.Unlock()
+	if t != nil {
+		names, versions := a.subscriptionState(rType)
+		t.SendRequest(rType.TypeURL(), names, versions)
+	}
+
+	return func() { a.cancelWatch(rType, resourceName, watcher) }
+}
+
+// subscriptionState returns the full set of resource names currently
+// watched for rType, along with a map from resource name to last known
+// version for every one of those resources that has ever received a value.
+// It is used to build the discovery requests sent on (re)subscription: the
+// version map becomes initial_resource_versions on a Delta (Incremental)
+// stream, telling the management server it doesn't need to resend a
+// resource the authority is already up to date on; a SotW transport ignores
+// it, since it always sends the full state regardless.
+func (a *authority) subscriptionState(rType xdsresource.Type) (names []string, versions map[string]string) {
+	a.resourcesMu.Lock()
+	defer a.resourcesMu.Unlock()
+	byName := a.resources[rType]
+	names = make([]string, 0, len(byName))
+	for name, state := range byName {
+		names = append(names, name)
+		if state.version != "" {
+			if versions == nil {
+				versions = make(map[string]string, len(byName))
+			}
+			versions[name] = state.version
+		}
+	}
+	return names, versions
+}
+
+// cancelWatch removes watcher from the set of watchers for resourceName. If
+// it was the last watcher for that resource, the resource's state is
+// dropped entirely and an unsubscribe request is sent to the management
+// server.
+func (a *authority) cancelWatch(rType xdsresource.Type, resourceName string, watcher xdsresource.ResourceWatcher) {
+	a.resourcesMu.Lock()
+	byName, ok := a.resources[rType]
+	if !ok {
+		a.resourcesMu.Unlock()
+		return
+	}
+	state, ok := byName[resourceName]
+	if !ok {
+		a.resourcesMu.Unlock()
+		return
+	}
+	delete(state.watchers, watcher)
+	last := len(state.watchers) == 0
+	if last {
+		if state.wTimer != nil {
+			state.wTimer.Stop()
+		}
+		delete(byName, resourceName)
+	}
+	a.resourcesMu.Unlock()
+
+	if !last {
+		return
+	}
+	a.metrics.recordWatchRemoved(state.wState)
+	a.mu.Lock()
+	t := a.transport
+	a.mu.Unlock()
+	if t != nil {
+		names, versions := a.subscriptionState(rType)
+		t.SendRequest(rType.TypeURL(), names, versions)
+	}
+}
+
+// close releases all resources associated with the authority, including the
+// underlying transport and any outstanding timers.
+func (a *authority) close() {
+	a.mu.Lock()
+	a.closed = true
+	t := a.transport
+	if a.probeTimer != nil {
+		a.probeTimer.Stop()
+	}
+	a.mu.Unlock()
+	if t != nil {
+		t.Close()
+	}
+
+	a.resourcesMu.Lock()
+	for _, byName := range a.resources {
+		for _, state := range byName {
+			if state.wTimer != nil {
+				state.wTimer.Stop()
+			}
+		}
+	}
+	a.resourcesMu.Unlock()
+}
@@ -0,0 +1,182 @@
+/*
+ *
+ * Copyright 2023 gRPC authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package xdsclient
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/internal/grpclog"
+	"google.golang.org/grpc/internal/grpcsync"
+	"google.golang.org/grpc/xds/internal/xdsclient/bootstrap"
+	"google.golang.org/grpc/xds/internal/xdsclient/xdsresource"
+)
+
+// defaultAuthorityName is the key used in authorityManager.authorities for
+// the authority backing "old-style" resource names, i.e. anything that
+// isn't a federation-aware "xdstp://" name. It is not a legal bootstrap
+// authority name, so it can never collide with one parsed out of a resource
+// name.
+const defaultAuthorityName = ""
+
+// authorityManagerArgs bundles the arguments needed to construct an
+// authorityManager. All fields except cache are required; a nil cache
+// disables warm-start caching.
+type authorityManagerArgs struct {
+	bootstrapCfg       *bootstrap.Config
+	serializer         *grpcsync.CallbackSerializer
+	resourceTypeGetter func(string) xdsresource.Type
+	watchExpiryTimeout time.Duration
+	logger             *grpclog.PrefixLogger
+	cache              ResourceCache
+}
+
+// authorityManager owns the set of authority instances used to satisfy
+// resource watches, lazily creating one per distinct xDS federation
+// authority name encountered. It is the entry point xdsClient uses instead
+// of talking to a single authority directly, so that federated resource
+// names (of the form "xdstp://<authority>/<type>/<id>") can be routed to the
+// right management server.
+type authorityManager struct {
+	args authorityManagerArgs
+
+	mu          sync.Mutex
+	authorities map[string]*authority
+	closed      bool
+}
+
+// newAuthorityManager creates an authorityManager. No authorities are
+// created until the first watchResource call references them.
+func newAuthorityManager(args authorityManagerArgs) *authorityManager {
+	return &authorityManager{
+		args:        args,
+		authorities: make(map[string]*authority),
+	}
+}
+
+// watchResource parses resourceName, routes it to the authority that owns
+// it (creating that authority on first use), and registers the watch there.
+// A federated name whose authority is not present in the bootstrap
+// configuration fails the watch immediately with a watcher.OnError call,
+// rather than being silently dropped.
+//
+// The returned cancel function is safe to call at most once and unregisters
+// the watch from exactly the authority it was registered against.
+func (m *authorityManager) watchResource(rType xdsresource.Type, resourceName string, watcher xdsresource.ResourceWatcher) func() {
+	authorityName, err := authorityNameForResource(resourceName)
+	if err != nil {
+		m.args.serializer.Schedule(func(context.Context) { watcher.OnError(err, func() {}) })
+		return func() {}
+	}
+
+	a, err := m.getOrCreateAuthority(authorityName)
+	if err != nil {
+		m.args.serializer.Schedule(func(context.Context) { watcher.OnError(err, func() {}) })
+		return func() {}
+	}
+	return a.watchResource(rType, resourceName, watcher)
+}
+
+// getOrCreateAuthority returns the (possibly newly created) authority
+// responsible for authorityName. An empty authorityName selects the default
+// authority, built from the top-level bootstrap server config.
+func (m *authorityManager) getOrCreateAuthority(authorityName string) (*authority, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil, fmt.Errorf("xds: authority manager is closed")
+	}
+	if a, ok := m.authorities[authorityName]; ok {
+		return a, nil
+	}
+
+	serverCfg, fallbackCfgs, err := m.serverConfigsForAuthority(authorityName)
+	if err != nil {
+		return nil, err
+	}
+
+	a, err := newAuthority(authorityArgs{
+		serverCfg:          serverCfg,
+		fallbackServerCfgs: fallbackCfgs,
+		bootstrapCfg:       m.args.bootstrapCfg,
+		serializer:         m.args.serializer,
+		resourceTypeGetter: m.args.resourceTypeGetter,
+		watchExpiryTimeout: m.args.watchExpiryTimeout,
+		logger:             m.args.logger,
+		cache:              m.args.cache,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("xds: failed to create authority %q: %v", authorityName, err)
+	}
+	m.authorities[authorityName] = a
+	return a, nil
+}
+
+// serverConfigsForAuthority looks up the ordered list of management servers
+// configured for authorityName, split into the primary (index 0) and any
+// fallback servers, as newAuthority expects them.
+func (m *authorityManager) serverConfigsForAuthority(authorityName string) (primary *bootstrap.ServerConfig, fallbacks []*bootstrap.ServerConfig, err error) {
+	if authorityName == defaultAuthorityName {
+		if len(m.args.bootstrapCfg.XDSServers) == 0 {
+			return nil, nil, fmt.Errorf("xds: no top-level xds_servers configured in bootstrap")
+		}
+		return m.args.bootstrapCfg.XDSServers[0], m.args.bootstrapCfg.XDSServers[1:], nil
+	}
+
+	authCfg, ok := m.args.bootstrapCfg.Authorities[authorityName]
+	if !ok {
+		return nil, nil, fmt.Errorf("xds: authority %q not found in bootstrap configuration", authorityName)
+	}
+	if len(authCfg.XDSServers) == 0 {
+		return nil, nil, fmt.Errorf("xds: authority %q has no xds_servers configured", authorityName)
+	}
+	return authCfg.XDSServers[0], authCfg.XDSServers[1:], nil
+}
+
+// authorityNameForResource returns the bootstrap authority name that should
+// own resourceName: defaultAuthorityName for a plain (non-"xdstp://") name,
+// or the authority segment of an "xdstp://<authority>/..." name.
+func authorityNameForResource(resourceName string) (string, error) {
+	name, err := xdsresource.ParseName(resourceName)
+	if err != nil {
+		return "", fmt.Errorf("xds: invalid resource name %q: %v", resourceName, err)
+	}
+	if name.Scheme != xdsresource.FederationScheme {
+		return defaultAuthorityName, nil
+	}
+	return name.Authority, nil
+}
+
+// close shuts down every authority currently owned by the manager.
+func (m *authorityManager) close() {
+	m.mu.Lock()
+	m.closed = true
+	authorities := make([]*authority, 0, len(m.authorities))
+	for _, a := range m.authorities {
+		authorities = append(authorities, a)
+	}
+	m.mu.Unlock()
+
+	for _, a := range authorities {
+		a.close()
+	}
+}
@@ -0,0 +1,132 @@
+/*
+ *
+ * Copyright 2023 gRPC authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package xdsclient
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"google.golang.org/grpc/internal/grpcsync"
+	"google.golang.org/grpc/internal/testutils/xds/e2e"
+	"google.golang.org/grpc/xds/internal/testutils"
+	xdstestutils "google.golang.org/grpc/xds/internal/testutils"
+	"google.golang.org/grpc/xds/internal/xdsclient/bootstrap"
+	"google.golang.org/grpc/xds/internal/xdsclient/xdsresource"
+
+	v3corepb "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+)
+
+const testAuthorityName = "authority.example.com"
+
+// setupFederationTest spins up two management servers: one backs the
+// default (non-federated) authority, the other backs testAuthorityName. It
+// returns an authorityManager wired up to both.
+func setupFederationTest(ctx context.Context, t *testing.T) (mgr *authorityManager, msDefault, msFederated *e2e.ManagementServer, nodeID string) {
+	t.Helper()
+	nodeID = uuid.New().String()
+
+	msDefault, err := e2e.StartManagementServer(emptyServerOpts)
+	if err != nil {
+		t.Fatalf("Failed to spin up the default xDS management server: %q", err)
+	}
+	msFederated, err = e2e.StartManagementServer(emptyServerOpts)
+	if err != nil {
+		t.Fatalf("Failed to spin up the federated xDS management server: %q", err)
+	}
+
+	bootstrapCfg := &bootstrap.Config{
+		NodeProto: &v3corepb.Node{Id: nodeID},
+		XDSServers: []*bootstrap.ServerConfig{
+			xdstestutils.ServerConfigForAddress(t, msDefault.Address),
+		},
+		Authorities: map[string]*bootstrap.Authority{
+			testAuthorityName: {
+				XDSServers: []*bootstrap.ServerConfig{
+					xdstestutils.ServerConfigForAddress(t, msFederated.Address),
+				},
+			},
+		},
+	}
+
+	mgr = newAuthorityManager(authorityManagerArgs{
+		bootstrapCfg:       bootstrapCfg,
+		serializer:         grpcsync.NewCallbackSerializer(ctx),
+		resourceTypeGetter: rtRegistry.get,
+		watchExpiryTimeout: defaultTestTimeout,
+		logger:             nil,
+	})
+	return mgr, msDefault, msFederated, nodeID
+}
+
+// This test registers a watch against the default authority and a watch
+// against a federated ("xdstp://") name, each backed by its own management
+// server, and confirms that stopping the federated server's authority only
+// affects the federated watch: the default authority's watch, and its
+// underlying ADS stream, are left completely undisturbed.
+func (s) TestAuthorityManagerFederatedFailureIsolatedFromDefault(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	mgr, msDefault, msFederated, nodeID := setupFederationTest(ctx, t)
+	defer mgr.close()
+	defer msDefault.Stop()
+
+	defaultName := "xdsclient-test-lds-resource"
+	defaultWatcher := testutils.NewTestResourceWatcher()
+	cancelDefault := mgr.watchResource(listenerResourceType, defaultName, defaultWatcher)
+	defer cancelDefault()
+
+	federatedName := "xdstp://" + testAuthorityName + "/" + listenerResourceType.TypeURL() + "/xdsclient-test-federated-lds-resource"
+	federatedWatcher := testutils.NewTestResourceWatcher()
+	cancelFederated := mgr.watchResource(listenerResourceType, federatedName, federatedWatcher)
+	defer cancelFederated()
+
+	if err := updateResourceInServer(ctx, msDefault, defaultName, nodeID); err != nil {
+		t.Fatalf("Failed to update default server with resource: %q; err: %q", defaultName, err)
+	}
+	select {
+	case <-ctx.Done():
+		t.Fatal("Test timed out before the default-authority watcher received an update.")
+	case err := <-defaultWatcher.ErrorCh:
+		t.Fatalf("Default-authority watch got an unexpected error update: %q; want: valid update.", err)
+	case <-defaultWatcher.UpdateCh:
+	}
+
+	// Stopping the federated server's management server should only error
+	// out the federated watch.
+	msFederated.Stop()
+	select {
+	case <-ctx.Done():
+		t.Fatal("Test timed out waiting for the federated watcher's connection error.")
+	case gotErr := <-federatedWatcher.ErrorCh:
+		if xdsresource.ErrType(gotErr) != xdsresource.ErrorTypeConnection {
+			t.Fatalf("Federated watch got an unexpected error: %q. Want: %q.", gotErr, xdsresource.ErrorTypeConnection)
+		}
+	}
+
+	// Give the default watch a moment to (incorrectly) be disturbed, if the
+	// authorities weren't actually isolated from each other.
+	select {
+	case <-time.After(100 * time.Millisecond):
+	case err := <-defaultWatcher.ErrorCh:
+		t.Fatalf("Default-authority watch got an unexpected error after the federated server was stopped: %q.", err)
+	}
+}
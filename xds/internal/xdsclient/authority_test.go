@@ -37,6 +37,7 @@ import (
 	v3corepb "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	v3listenerpb "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
 	v3discoverypb "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"google.golang.org/protobuf/types/known/anypb"
 
 	_ "google.golang.org/grpc/xds/internal/httpfilter/router" // Register the router filter.
 )
@@ -81,6 +82,138 @@ func setupTest(ctx context.Context, t *testing.T, opts e2e.ManagementServerOptio
 	return a, ms, nodeID
 }
 
+// setupTestDelta is like setupTest, but configures the server_features
+// bootstrap entry so that the authority opens a Delta (Incremental) ADS
+// stream (DeltaAggregatedResources) to the management server, instead of
+// the default State-of-the-World one (StreamAggregatedResources).
+func setupTestDelta(ctx context.Context, t *testing.T, opts e2e.ManagementServerOptions, watchExpiryTimeout time.Duration) (*authority, *e2e.ManagementServer, string) {
+	t.Helper()
+	nodeID := uuid.New().String()
+	ms, err := e2e.StartManagementServer(opts)
+	if err != nil {
+		t.Fatalf("Failed to spin up the xDS management server: %q", err)
+	}
+
+	a, err := newAuthority(authorityArgs{
+		serverCfg: xdstestutils.ServerConfigForAddressWithFeatures(t, ms.Address, []string{serverFeatureDeltaXDS}),
+		bootstrapCfg: &bootstrap.Config{
+			NodeProto: &v3corepb.Node{Id: nodeID},
+		},
+		serializer:         grpcsync.NewCallbackSerializer(ctx),
+		resourceTypeGetter: rtRegistry.get,
+		watchExpiryTimeout: watchExpiryTimeout,
+		logger:             nil,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create authority: %q", err)
+	}
+	return a, ms, nodeID
+}
+
+// setupTestDeltaWithFallback is like setupTestWithFallback, but configures
+// both servers with the server_features bootstrap entry so that the
+// authority talks Delta (Incremental) ADS to whichever one is active,
+// including across the fallback switch. ms2Opts is passed through to the
+// fallback server's construction, e.g. to hook OnStreamDeltaRequest.
+func setupTestDeltaWithFallback(ctx context.Context, t *testing.T, watchExpiryTimeout time.Duration, ms2Opts e2e.ManagementServerOptions, onFallback func(prevIdx, newIdx int)) (a *authority, ms1, ms2 *e2e.ManagementServer, nodeID string) {
+	t.Helper()
+	nodeID = uuid.New().String()
+
+	ms1, err := e2e.StartManagementServer(emptyServerOpts)
+	if err != nil {
+		t.Fatalf("Failed to spin up the primary xDS management server: %q", err)
+	}
+	ms2, err = e2e.StartManagementServer(ms2Opts)
+	if err != nil {
+		t.Fatalf("Failed to spin up the fallback xDS management server: %q", err)
+	}
+
+	a, err = newAuthority(authorityArgs{
+		serverCfg:          xdstestutils.ServerConfigForAddressWithFeatures(t, ms1.Address, []string{serverFeatureDeltaXDS}),
+		fallbackServerCfgs: []*bootstrap.ServerConfig{xdstestutils.ServerConfigForAddressWithFeatures(t, ms2.Address, []string{serverFeatureDeltaXDS})},
+		bootstrapCfg: &bootstrap.Config{
+			NodeProto: &v3corepb.Node{Id: nodeID},
+		},
+		serializer:           grpcsync.NewCallbackSerializer(ctx),
+		resourceTypeGetter:   rtRegistry.get,
+		watchExpiryTimeout:   watchExpiryTimeout,
+		onFallbackForTesting: onFallback,
+		backoffForTesting:    func(int) time.Duration { return time.Millisecond },
+		logger:               nil,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create authority: %q", err)
+	}
+	return a, ms1, ms2, nodeID
+}
+
+// setupTestWithCache is like setupTest, but wires the given ResourceCache
+// into the authority, so that watches registered against it can be served a
+// warm-start value before the ADS stream to ms has delivered anything.
+func setupTestWithCache(ctx context.Context, t *testing.T, opts e2e.ManagementServerOptions, watchExpiryTimeout time.Duration, cache ResourceCache) (*authority, *e2e.ManagementServer, string) {
+	t.Helper()
+	nodeID := uuid.New().String()
+	ms, err := e2e.StartManagementServer(opts)
+	if err != nil {
+		t.Fatalf("Failed to spin up the xDS management server: %q", err)
+	}
+
+	a, err := newAuthority(authorityArgs{
+		serverCfg: xdstestutils.ServerConfigForAddress(t, ms.Address),
+		bootstrapCfg: &bootstrap.Config{
+			NodeProto: &v3corepb.Node{Id: nodeID},
+		},
+		serializer:         grpcsync.NewCallbackSerializer(ctx),
+		resourceTypeGetter: rtRegistry.get,
+		watchExpiryTimeout: watchExpiryTimeout,
+		cache:              cache,
+		logger:             nil,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create authority: %q", err)
+	}
+	return a, ms, nodeID
+}
+
+// setupTestWithFallback is like setupTest, but additionally spins up a
+// second management server and configures the authority to fall back to it
+// when the primary (ms1) repeatedly fails. onFallback is invoked every time
+// the authority switches its active server. The per-server retry backoff is
+// overridden to a negligible delay, so that tests don't have to wait out
+// maxConsecutiveStreamErrorsBeforeFallback real backoff delays before a
+// fallback switch happens.
+func setupTestWithFallback(ctx context.Context, t *testing.T, watchExpiryTimeout time.Duration, onFallback func(prevIdx, newIdx int)) (a *authority, ms1, ms2 *e2e.ManagementServer, nodeID string) {
+	t.Helper()
+	nodeID = uuid.New().String()
+
+	ms1, err := e2e.StartManagementServer(emptyServerOpts)
+	if err != nil {
+		t.Fatalf("Failed to spin up the primary xDS management server: %q", err)
+	}
+	ms2, err = e2e.StartManagementServer(emptyServerOpts)
+	if err != nil {
+		t.Fatalf("Failed to spin up the fallback xDS management server: %q", err)
+	}
+
+	a, err = newAuthority(authorityArgs{
+		serverCfg:          xdstestutils.ServerConfigForAddress(t, ms1.Address),
+		fallbackServerCfgs: []*bootstrap.ServerConfig{xdstestutils.ServerConfigForAddress(t, ms2.Address)},
+		bootstrapCfg: &bootstrap.Config{
+			NodeProto: &v3corepb.Node{Id: nodeID},
+		},
+		serializer:           grpcsync.NewCallbackSerializer(ctx),
+		resourceTypeGetter:   rtRegistry.get,
+		watchExpiryTimeout:   watchExpiryTimeout,
+		onFallbackForTesting: onFallback,
+		backoffForTesting:    func(int) time.Duration { return time.Millisecond },
+		logger:               nil,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create authority: %q", err)
+	}
+	return a, ms1, ms2, nodeID
+}
+
 // This tests verifies watch and timer state for the scenario where a watch for
 // an LDS resource is registered and the management server sends an update the
 // same resource.
@@ -140,6 +273,195 @@ func (s) TestTimerAndWatchStateOnSendCallback(t *testing.T) {
 
 }
 
+// This is the Delta (Incremental) xDS counterpart to
+// TestTimerAndWatchStateOnSendCallback: it exercises the exact same watch
+// state transitions (watchStateStarted -> watchStateRequested ->
+// watchStateReceived) but with the authority talking
+// DeltaAggregatedResources to the management server instead of
+// StreamAggregatedResources.
+func (s) TestTimerAndWatchStateOnSendCallback_DeltaXDS(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+	serverOnReqDoneCh := make(chan struct{})
+	serverOpt := e2e.ManagementServerOptions{
+		OnStreamDeltaRequest: func(int64, *v3discoverypb.DeltaDiscoveryRequest) error {
+			select {
+			case serverOnReqDoneCh <- struct{}{}:
+			default:
+			}
+			return nil
+		},
+	}
+	a, ms, nodeID := setupTestDelta(ctx, t, serverOpt, defaultTestTimeout)
+	defer ms.Stop()
+	defer a.close()
+
+	rn := "xdsclient-test-lds-resource"
+	w := testutils.NewTestResourceWatcher()
+	cancelResource := a.watchResource(listenerResourceType, rn, w)
+	defer cancelResource()
+
+	if err := compareWatchState(a, rn, watchStateStarted); err != nil {
+		t.Fatal(err)
+	}
+
+	<-serverOnReqDoneCh
+	if err := compareWatchState(a, rn, watchStateRequested); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := updateResourceInServer(ctx, ms, rn, nodeID); err != nil {
+		t.Fatalf("Failed to update server with resource: %q; err: %q", rn, err)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			t.Fatal("Test timed out before watcher received an update from server.")
+		case <-w.ErrorCh:
+		case <-w.UpdateCh:
+			if err := compareWatchState(a, rn, watchStateReceived); err != nil {
+				t.Fatal(err)
+			}
+			return
+		}
+	}
+}
+
+// This test verifies that, on a Delta (Incremental) ADS stream, an explicit
+// removal of a resource (the management server sending it in
+// RemovedResources) transitions the watch back to watchStateStarted and
+// clears its cached version.
+func (s) TestDeltaXDSResourceRemoval(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+	a, ms, nodeID := setupTestDelta(ctx, t, emptyServerOpts, defaultTestTimeout)
+	defer ms.Stop()
+	defer a.close()
+
+	rn := "xdsclient-test-lds-resource"
+	w := testutils.NewTestResourceWatcher()
+	cancelResource := a.watchResource(listenerResourceType, rn, w)
+	defer cancelResource()
+
+	if err := updateResourceInServer(ctx, ms, rn, nodeID); err != nil {
+		t.Fatalf("Failed to update server with resource: %q; err: %q", rn, err)
+	}
+	select {
+	case <-ctx.Done():
+		t.Fatal("Test timed out before watcher received an update from server.")
+	case err := <-w.ErrorCh:
+		t.Fatalf("Watch got an unexpected error update: %q; want: valid update.", err)
+	case <-w.UpdateCh:
+		if err := compareWatchState(a, rn, watchStateReceived); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v := resourceVersionForTesting(a, rn); v == "" {
+		t.Fatal("Resource version not recorded after update; want non-empty version.")
+	}
+
+	// Updating the server with no listeners removes rn: the management
+	// server reports it via RemovedResources on the Delta stream, which
+	// should take the watch back to watchStateStarted and invalidate the
+	// cached version.
+	if err := ms.Update(ctx, e2e.UpdateOptions{NodeID: nodeID, SkipValidation: true}); err != nil {
+		t.Fatalf("Failed to remove resource %q from server: %q", rn, err)
+	}
+	ticker := time.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			t.Fatal("Test timed out before the watch was reset following the resource removal.")
+		case <-w.UpdateCh:
+			t.Fatal("Watch got an unexpected update; want: resource removed, no further update.")
+		case <-ticker.C:
+			if compareWatchState(a, rn, watchStateStarted) == nil {
+				if v := resourceVersionForTesting(a, rn); v != "" {
+					t.Fatalf("Resource version = %q after removal; want empty.", v)
+				}
+				return
+			}
+		}
+	}
+}
+
+// This test verifies that, on a Delta (Incremental) ADS stream, a watch that
+// already received a value before a fallback switch carries its last known
+// version over to the new stream as part of initial_resource_versions, so
+// the (new) active server knows it doesn't have to resend a value the
+// authority is already up to date on.
+func (s) TestDeltaXDSInitialResourceVersionsOnFallback(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	rn := "xdsclient-test-lds-resource"
+	var gotInitialVersions map[string]string
+	deltaReqCh := make(chan struct{}, 1)
+	ms2Opts := e2e.ManagementServerOptions{
+		OnStreamDeltaRequest: func(_ int64, req *v3discoverypb.DeltaDiscoveryRequest) error {
+			if len(req.GetInitialResourceVersions()) > 0 {
+				gotInitialVersions = req.GetInitialResourceVersions()
+				select {
+				case deltaReqCh <- struct{}{}:
+				default:
+				}
+			}
+			return nil
+		},
+	}
+
+	fallbackCh := make(chan struct{}, 1)
+	a, ms1, ms2, nodeID := setupTestDeltaWithFallback(ctx, t, defaultTestTimeout, ms2Opts, func(prevIdx, newIdx int) {
+		if prevIdx == 0 && newIdx == 1 {
+			select {
+			case fallbackCh <- struct{}{}:
+			default:
+			}
+		}
+	})
+	defer ms2.Stop()
+	defer a.close()
+
+	w := testutils.NewTestResourceWatcher()
+	cancelResource := a.watchResource(listenerResourceType, rn, w)
+	defer cancelResource()
+
+	if err := updateResourceInServer(ctx, ms1, rn, nodeID); err != nil {
+		t.Fatalf("Failed to update server with resource: %q; err: %q", rn, err)
+	}
+	var wantVersion string
+	select {
+	case <-ctx.Done():
+		t.Fatal("Test timed out before watcher received an update from the primary server.")
+	case err := <-w.ErrorCh:
+		t.Fatalf("Watch got an unexpected error update: %q; want: valid update.", err)
+	case <-w.UpdateCh:
+		wantVersion = resourceVersionForTesting(a, rn)
+		if wantVersion == "" {
+			t.Fatal("Resource version not recorded after update; want non-empty version.")
+		}
+	}
+
+	// Killing the primary should fall the authority back to ms2, replaying
+	// the subscription for rn with its already known version.
+	ms1.Stop()
+	select {
+	case <-ctx.Done():
+		t.Fatal("Test timed out before the authority fell back to the secondary server.")
+	case <-fallbackCh:
+	}
+
+	select {
+	case <-ctx.Done():
+		t.Fatal("Test timed out before the fallback server received initial_resource_versions.")
+	case <-deltaReqCh:
+	}
+	if got := gotInitialVersions[rn]; got != wantVersion {
+		t.Fatalf("initial_resource_versions[%q] = %q; want %q.", rn, got, wantVersion)
+	}
+}
+
 // This tests the resource's watch state transition when the ADS stream is closed
 // by the management server. After the test calls `watchResource` api to register
 // a watch for a resource, it stops the management server, and verifies the resource's
@@ -174,6 +496,184 @@ func (s) TestTimerAndWatchStateOnErrorCallback(t *testing.T) {
 	}
 }
 
+// This test verifies that the watch state counters exposed via
+// authority.MetricsForTesting track a resource's watch through
+// watchStateStarted, watchStateRequested and watchStateReceived, instead of
+// tests having to reach into a.resources directly (as compareWatchState
+// does).
+func (s) TestMetricsForTestingTracksWatchState(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+	serverOnReqDoneCh := make(chan struct{})
+	serverOpt := e2e.ManagementServerOptions{
+		OnStreamRequest: func(int64, *v3discoverypb.DiscoveryRequest) error {
+			select {
+			case serverOnReqDoneCh <- struct{}{}:
+			default:
+			}
+			return nil
+		},
+	}
+	a, ms, nodeID := setupTest(ctx, t, serverOpt, defaultTestTimeout)
+	defer ms.Stop()
+	defer a.close()
+
+	rn := "xdsclient-test-lds-resource"
+	w := testutils.NewTestResourceWatcher()
+	cancelResource := a.watchResource(listenerResourceType, rn, w)
+	defer cancelResource()
+
+	if got := a.MetricsForTesting(); got.WatchesStarted != 1 {
+		t.Fatalf("MetricsForTesting() = %+v; want WatchesStarted = 1", got)
+	}
+
+	<-serverOnReqDoneCh
+	if got := a.MetricsForTesting(); got.WatchesRequested != 1 || got.WatchesStarted != 0 {
+		t.Fatalf("MetricsForTesting() = %+v; want WatchesRequested = 1, WatchesStarted = 0", got)
+	}
+
+	if err := updateResourceInServer(ctx, ms, rn, nodeID); err != nil {
+		t.Fatalf("Failed to update server with resource: %q; err: %q", rn, err)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			t.Fatal("Test timed out before watcher received an update from server.")
+		case <-w.ErrorCh:
+		case <-w.UpdateCh:
+			if got := a.MetricsForTesting(); got.WatchesReceived != 1 || got.WatchesRequested != 0 {
+				t.Fatalf("MetricsForTesting() = %+v; want WatchesReceived = 1, WatchesRequested = 0", got)
+			}
+			return
+		}
+	}
+}
+
+// This test verifies that a watch registered against an authority backed by
+// a warm ResourceCache is immediately served the cached value (with the
+// watch starting in watchStateCached, rather than leaving the watcher
+// without any update until the ADS stream connects), and that the watch
+// still transitions through watchStateRequested and watchStateReceived once
+// the stream sends the request and the management server responds.
+func (s) TestWatchResourceServesCachedValueOnWarmStart(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	cache, err := NewFileResourceCache(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create file resource cache: %q", err)
+	}
+
+	rn := "xdsclient-test-lds-resource"
+	cachedAny, err := anypb.New(e2e.DefaultClientListener(rn, "cached-rds-resource"))
+	if err != nil {
+		t.Fatalf("Failed to build cached listener resource: %q", err)
+	}
+	if err := cache.Set(listenerResourceType.TypeURL(), rn, cachedAny); err != nil {
+		t.Fatalf("Failed to seed resource cache: %q", err)
+	}
+
+	serverOnReqDoneCh := make(chan struct{})
+	serverOpt := e2e.ManagementServerOptions{
+		OnStreamRequest: func(int64, *v3discoverypb.DiscoveryRequest) error {
+			select {
+			case serverOnReqDoneCh <- struct{}{}:
+			default:
+			}
+			return nil
+		},
+	}
+	a, ms, nodeID := setupTestWithCache(ctx, t, serverOpt, defaultTestTimeout, cache)
+	defer ms.Stop()
+	defer a.close()
+
+	w := testutils.NewTestResourceWatcher()
+	cancelResource := a.watchResource(listenerResourceType, rn, w)
+	defer cancelResource()
+
+	// The watcher should be served the cached value right away, without
+	// waiting for the ADS stream to connect.
+	select {
+	case <-ctx.Done():
+		t.Fatal("Test timed out before watcher received the cached value.")
+	case err := <-w.ErrorCh:
+		t.Fatalf("Watch got an unexpected error update: %q; want: cached value.", err)
+	case <-w.UpdateCh:
+	}
+
+	<-serverOnReqDoneCh
+	if err := compareWatchState(a, rn, watchStateRequested); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := updateResourceInServer(ctx, ms, rn, nodeID); err != nil {
+		t.Fatalf("Failed to update server with resource: %q; err: %q", rn, err)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			t.Fatal("Test timed out before watcher received an update from server.")
+		case <-w.ErrorCh:
+		case <-w.UpdateCh:
+			if err := compareWatchState(a, rn, watchStateReceived); err != nil {
+				t.Fatal(err)
+			}
+			return
+		}
+	}
+}
+
+// This test verifies that when the primary management server becomes
+// unreachable, the authority switches over to the configured fallback
+// server instead of surfacing a connection error to watchers, and that all
+// in-flight watches are re-requested (and eventually satisfied) on the new
+// stream.
+func (s) TestAuthorityFallsBackOnPrimaryError(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	fallbackCh := make(chan struct{}, 1)
+	a, ms1, ms2, nodeID := setupTestWithFallback(ctx, t, defaultTestTimeout, func(prevIdx, newIdx int) {
+		if prevIdx == 0 && newIdx == 1 {
+			select {
+			case fallbackCh <- struct{}{}:
+			default:
+			}
+		}
+	})
+	defer ms2.Stop()
+	defer a.close()
+
+	rn := "xdsclient-test-lds-resource"
+	w := testutils.NewTestResourceWatcher()
+	cancelResource := a.watchResource(listenerResourceType, rn, w)
+	defer cancelResource()
+
+	// Killing the primary server should cause the authority to fall back to
+	// ms2, rather than delivering a connection error to the watcher.
+	ms1.Stop()
+
+	select {
+	case <-ctx.Done():
+		t.Fatal("Test timed out before the authority fell back to the secondary server.")
+	case <-fallbackCh:
+	}
+
+	if err := updateResourceInServer(ctx, ms2, rn, nodeID); err != nil {
+		t.Fatalf("Failed to update fallback server with resource: %q; err: %q", rn, err)
+	}
+	select {
+	case <-ctx.Done():
+		t.Fatal("Test timed out before watcher received an update from the fallback server.")
+	case err := <-w.ErrorCh:
+		t.Fatalf("Watch got an unexpected error update: %q; want: valid update from fallback server.", err)
+	case <-w.UpdateCh:
+		if err := compareWatchState(a, rn, watchStateReceived); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
 // This tests the case where the ADS stream breaks after successfully receiving
 // a message on the stream. The test performs the following:
 //   - configures the management server with resourceA.
@@ -242,6 +742,15 @@ func (s) TestWatchResourceTimerCanRestartOnIgnoredADSRecvError(t *testing.T) {
 
 }
 
+// resourceVersionForTesting returns the last known version recorded for rn,
+// as maintained by handleResourceUpdate/handleResourceRemoved, so that tests
+// can assert on it without reaching past a.resources directly.
+func resourceVersionForTesting(a *authority, rn string) string {
+	a.resourcesMu.Lock()
+	defer a.resourcesMu.Unlock()
+	return a.resources[listenerResourceType][rn].version
+}
+
 func compareWatchState(a *authority, rn string, wantState watchState) error {
 	a.resourcesMu.Lock()
 	defer a.resourcesMu.Unlock()
@@ -256,7 +765,7 @@ func compareWatchState(a *authority, rn string, wantState watchState) error {
 		if wTimer == nil {
 			return fmt.Errorf("got nil timer, want active timer")
 		}
-	case watchStateStarted:
+	case watchStateStarted, watchStateCached:
 		if wTimer != nil {
 			return fmt.Errorf("got active timer, want nil timer")
 		}
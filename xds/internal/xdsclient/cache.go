@@ -0,0 +1,117 @@
+/*
+ *
+ * Copyright 2023 gRPC authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package xdsclient
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// ResourceCache persists the last successfully received value of an xDS
+// resource, keyed by the resource's type URL and name, so that a fresh
+// authority can serve watchers a reasonable (if possibly stale) value while
+// its ADS stream is still connecting, instead of leaving them without any
+// update at all.
+//
+// Implementations must be safe for concurrent use.
+type ResourceCache interface {
+	// Get returns the last persisted value for the resource identified by
+	// typeURL and resourceName, and reports whether one was found.
+	Get(typeURL, resourceName string) (*anypb.Any, bool)
+
+	// Set persists resource as the most recently received value for the
+	// resource identified by typeURL and resourceName.
+	Set(typeURL, resourceName string, resource *anypb.Any) error
+}
+
+// fileResourceCache is the default, file-based ResourceCache implementation.
+// Each cached resource is stored as a serialized anypb.Any in its own file
+// under dir, named after a hash of its type URL and resource name.
+type fileResourceCache struct {
+	dir string
+}
+
+// NewFileResourceCache returns a ResourceCache that persists resources as
+// individual files under dir. dir is created (including any missing
+// parents) if it does not already exist.
+func NewFileResourceCache(dir string) (ResourceCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("xds: failed to create resource cache directory %q: %v", dir, err)
+	}
+	return &fileResourceCache{dir: dir}, nil
+}
+
+func (c *fileResourceCache) Get(typeURL, resourceName string) (*anypb.Any, bool) {
+	b, err := os.ReadFile(c.path(typeURL, resourceName))
+	if err != nil {
+		return nil, false
+	}
+	a := new(anypb.Any)
+	if err := proto.Unmarshal(b, a); err != nil {
+		return nil, false
+	}
+	return a, true
+}
+
+func (c *fileResourceCache) Set(typeURL, resourceName string, resource *anypb.Any) error {
+	b, err := proto.Marshal(resource)
+	if err != nil {
+		return fmt.Errorf("xds: failed to marshal resource %q of type %q for caching: %v", resourceName, typeURL, err)
+	}
+	// Write to a uniquely named temp file, rather than a fixed one derived
+	// from path(), so that concurrent Set calls for the same resource (e.g.
+	// from two transports briefly live across a fallback switch) never race
+	// on the same temp file: each gets its own, and the final rename is
+	// atomic.
+	tmp, err := os.CreateTemp(c.dir, "tmp-*")
+	if err != nil {
+		return fmt.Errorf("xds: failed to create resource cache temp file: %v", err)
+	}
+	_, werr := tmp.Write(b)
+	cerr := tmp.Close()
+	if werr != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("xds: failed to write resource cache file: %v", werr)
+	}
+	if cerr != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("xds: failed to close resource cache temp file: %v", cerr)
+	}
+	if err := os.Rename(tmp.Name(), c.path(typeURL, resourceName)); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("xds: failed to rename resource cache file into place: %v", err)
+	}
+	return nil
+}
+
+// path returns the on-disk location used to cache the given resource. The
+// type URL and resource name are hashed together (rather than used directly
+// as path components) since resource names may contain characters that
+// aren't valid in file names, e.g. the "xdstp://" scheme used by federation
+// aware resource names.
+func (c *fileResourceCache) path(typeURL, resourceName string) string {
+	h := sha256.Sum256([]byte(typeURL + "\x00" + resourceName))
+	return filepath.Join(c.dir, hex.EncodeToString(h[:]))
+}
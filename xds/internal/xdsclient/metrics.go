@@ -0,0 +1,227 @@
+/*
+ *
+ * Copyright 2023 gRPC authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package xdsclient
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/noop"
+)
+
+const metricsInstrumentationScope = "grpc-go/xds/internal/xdsclient"
+
+// authorityMetrics records the OpenTelemetry instruments an authority uses
+// to report on its watch state machine and ADS stream health. It also
+// mirrors every counter (but not the time-to-first-response histogram, and
+// NACKs only as a total across types) into plain atomic counters so that
+// tests can assert
+// on them through MetricsForTesting instead of reaching into private
+// authority fields.
+type authorityMetrics struct {
+	watchesByState    metric.Int64UpDownCounter
+	watchExpiries     metric.Int64Counter
+	streamReconnects  metric.Int64Counter
+	timeToFirstUpdate metric.Float64Histogram
+	nacksByType       metric.Int64Counter
+
+	watchesStarted   atomic.Int64
+	watchesRequested atomic.Int64
+	watchesReceived  atomic.Int64
+	watchesTimedOut  atomic.Int64
+	watchExpiryCount atomic.Int64
+	reconnectCount   atomic.Int64
+	nackCount        atomic.Int64
+}
+
+// AuthorityMetricsSnapshot is a point-in-time read of an authority's
+// instrumentation, returned by authority.MetricsForTesting.
+type AuthorityMetricsSnapshot struct {
+	WatchesStarted   int64
+	WatchesRequested int64
+	WatchesReceived  int64
+	WatchesTimedOut  int64
+	WatchExpiries    int64
+	StreamReconnects int64
+	NACKs            int64
+}
+
+// newAuthorityMetrics creates the instruments used by an authority, reading
+// them off of mp. A nil mp falls back to the OpenTelemetry no-op provider,
+// so instrumentation is always safe to use unconditionally.
+func newAuthorityMetrics(mp metric.MeterProvider) (*authorityMetrics, error) {
+	if mp == nil {
+		mp = noop.NewMeterProvider()
+	}
+	meter := mp.Meter(metricsInstrumentationScope)
+
+	watchesByState, err := meter.Int64UpDownCounter(
+		"grpc.xds_client.resource_watches",
+		metric.WithDescription("Number of resource watches currently in each watch state."),
+		metric.WithUnit("{watch}"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	watchExpiries, err := meter.Int64Counter(
+		"grpc.xds_client.watch_expiries",
+		metric.WithDescription("Number of times a resource watch's expiry timer fired before a response was received."),
+		metric.WithUnit("{expiry}"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	streamReconnects, err := meter.Int64Counter(
+		"grpc.xds_client.ads_stream_reconnects",
+		metric.WithDescription("Number of times the ADS stream to a management server had to be reconnected."),
+		metric.WithUnit("{reconnect}"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	timeToFirstUpdate, err := meter.Float64Histogram(
+		"grpc.xds_client.time_to_first_response",
+		metric.WithDescription("Time between a resource being watched and its first update being received, in seconds."),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	nacksByType, err := meter.Int64Counter(
+		"grpc.xds_client.resource_nacks",
+		metric.WithDescription("Number of resource updates rejected (NACKed) by the xDS client, by resource type."),
+		metric.WithUnit("{nack}"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &authorityMetrics{
+		watchesByState:    watchesByState,
+		watchExpiries:     watchExpiries,
+		streamReconnects:  streamReconnects,
+		timeToFirstUpdate: timeToFirstUpdate,
+		nacksByType:       nacksByType,
+	}, nil
+}
+
+// recordWatchStateChange records a transition of one resource watch from
+// `from` to `to`.
+func (m *authorityMetrics) recordWatchStateChange(from, to watchState) {
+	m.decrementState(from)
+	m.incrementState(to)
+}
+
+// recordWatchAdded records the initial state of a newly registered watch,
+// with no corresponding decrement of a prior state.
+func (m *authorityMetrics) recordWatchAdded(initial watchState) {
+	m.incrementState(initial)
+}
+
+// recordWatchRemoved records that a watch, last seen in state current, has
+// been canceled (every watcher for the resource went away), with no
+// corresponding increment of a new state.
+func (m *authorityMetrics) recordWatchRemoved(current watchState) {
+	m.decrementState(current)
+}
+
+func (m *authorityMetrics) incrementState(s watchState) {
+	m.watchesByState.Add(context.Background(), 1, metric.WithAttributes(attribute.String("state", s.String())))
+	m.counterFor(s).Add(1)
+}
+
+func (m *authorityMetrics) decrementState(s watchState) {
+	m.watchesByState.Add(context.Background(), -1, metric.WithAttributes(attribute.String("state", s.String())))
+	m.counterFor(s).Add(-1)
+}
+
+func (m *authorityMetrics) counterFor(s watchState) *atomic.Int64 {
+	switch s {
+	case watchStateRequested:
+		return &m.watchesRequested
+	case watchStateReceived:
+		return &m.watchesReceived
+	case watchStateTimeout:
+		return &m.watchesTimedOut
+	default:
+		// watchStateStarted and watchStateCached are both "not yet
+		// requested" from a reporting point of view.
+		return &m.watchesStarted
+	}
+}
+
+func (m *authorityMetrics) recordWatchExpiry() {
+	m.watchExpiries.Add(context.Background(), 1)
+	m.watchExpiryCount.Add(1)
+}
+
+func (m *authorityMetrics) recordStreamReconnect() {
+	m.streamReconnects.Add(context.Background(), 1)
+	m.reconnectCount.Add(1)
+}
+
+func (m *authorityMetrics) recordTimeToFirstUpdate(d time.Duration) {
+	m.timeToFirstUpdate.Record(context.Background(), d.Seconds())
+}
+
+func (m *authorityMetrics) recordNACK(typeURL string) {
+	m.nacksByType.Add(context.Background(), 1, metric.WithAttributes(attribute.String("type_url", typeURL)))
+	m.nackCount.Add(1)
+}
+
+func (m *authorityMetrics) snapshot() AuthorityMetricsSnapshot {
+	return AuthorityMetricsSnapshot{
+		WatchesStarted:   m.watchesStarted.Load(),
+		WatchesRequested: m.watchesRequested.Load(),
+		WatchesReceived:  m.watchesReceived.Load(),
+		WatchesTimedOut:  m.watchesTimedOut.Load(),
+		WatchExpiries:    m.watchExpiryCount.Load(),
+		StreamReconnects: m.reconnectCount.Load(),
+		NACKs:            m.nackCount.Load(),
+	}
+}
+
+// String returns the lowercase name of the watch state, used as the "state"
+// metric attribute.
+func (s watchState) String() string {
+	switch s {
+	case watchStateCached:
+		return "cached"
+	case watchStateStarted:
+		return "started"
+	case watchStateRequested:
+		return "requested"
+	case watchStateReceived:
+		return "received"
+	case watchStateTimeout:
+		return "timeout"
+	default:
+		return "unknown"
+	}
+}
+
+// MetricsForTesting returns a snapshot of this authority's OpenTelemetry
+// instrumentation. It exists so that tests can assert on metric values
+// instead of reaching into private fields such as resourceState.wState.
+func (a *authority) MetricsForTesting() AuthorityMetricsSnapshot {
+	return a.metrics.snapshot()
+}